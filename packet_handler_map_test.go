@@ -2,7 +2,11 @@ package quic
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
+	"net"
 	"time"
 
 	"github.com/golang/mock/gomock"
@@ -133,6 +137,66 @@ var _ = Describe("Packet Handler Map", func() {
 		})
 	})
 
+	Context("handling multiple connection IDs per session", func() {
+		It("routes packets for either connection ID to the same session", func() {
+			connID1 := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+			connID2 := protocol.ConnectionID{2, 3, 4, 5, 6, 7, 8, 9}
+			sess := NewMockPacketHandler(mockCtrl)
+			handler.Add(connID1, sess)
+			handler.AddConnectionID(connID2, sess)
+
+			handled1 := make(chan struct{})
+			sess.EXPECT().handlePacket(gomock.Any()).Do(func(p *receivedPacket) {
+				Expect(p.hdr.DestConnectionID).To(Equal(connID1))
+				close(handled1)
+			})
+			conn.dataToRead <- getPacket(connID1)
+			Eventually(handled1).Should(BeClosed())
+
+			handled2 := make(chan struct{})
+			sess.EXPECT().handlePacket(gomock.Any()).Do(func(p *receivedPacket) {
+				Expect(p.hdr.DestConnectionID).To(Equal(connID2))
+				close(handled2)
+			})
+			conn.dataToRead <- getPacket(connID2)
+			Eventually(handled2).Should(BeClosed())
+		})
+
+		It("retires one connection ID without affecting the other", func() {
+			handler.deleteRetiredSessionsAfter = scaleDuration(10 * time.Millisecond)
+			connID1 := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+			connID2 := protocol.ConnectionID{2, 3, 4, 5, 6, 7, 8, 9}
+			sess := NewMockPacketHandler(mockCtrl)
+			handler.AddConnectionID(connID1, sess)
+			handler.AddConnectionID(connID2, sess)
+
+			handler.RetireConnectionID(connID1)
+			time.Sleep(scaleDuration(30 * time.Millisecond))
+			Expect(handler.handlePacket(nil, getPacket(connID1))).To(MatchError("received a packet with an unexpected connection ID 0x0102030405060708"))
+
+			handled := make(chan struct{})
+			sess.EXPECT().handlePacket(gomock.Any()).Do(func(p *receivedPacket) {
+				close(handled)
+			})
+			Expect(handler.handlePacket(nil, getPacket(connID2))).To(Succeed())
+			Eventually(handled).Should(BeClosed())
+		})
+
+		It("frees all resources once the last connection ID is retired", func() {
+			handler.deleteRetiredSessionsAfter = scaleDuration(10 * time.Millisecond)
+			connID1 := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+			connID2 := protocol.ConnectionID{2, 3, 4, 5, 6, 7, 8, 9}
+			sess := NewMockPacketHandler(mockCtrl)
+			handler.AddConnectionID(connID1, sess)
+			handler.AddConnectionID(connID2, sess)
+
+			handler.RetireConnectionID(connID1)
+			handler.RetireConnectionID(connID2)
+			time.Sleep(scaleDuration(30 * time.Millisecond))
+			Expect(handler.handlers).To(BeEmpty())
+		})
+	})
+
 	Context("stateless reset handling", func() {
 		It("handles packets for connections added with a reset token", func() {
 			packetHandler := NewMockPacketHandler(mockCtrl)
@@ -177,6 +241,249 @@ var _ = Describe("Packet Handler Map", func() {
 			Expect(handler.handlePacket(nil, packet)).To(MatchError("received a short header packet with an unexpected connection ID 0xdecafbad99"))
 			Expect(handler.resetTokens).To(BeEmpty())
 		})
+
+		It("keeps distinct reset tokens for multiple connection IDs of the same session", func() {
+			connID1 := protocol.ConnectionID{0xde, 0xca, 0xfb, 0xad}
+			connID2 := protocol.ConnectionID{0xba, 0xdb, 0xee, 0xf5}
+			token1 := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+			token2 := [16]byte{16, 15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1}
+			sess := NewMockPacketHandler(mockCtrl)
+			handler.AddWithResetToken(connID1, sess, token1)
+			handler.AddWithResetToken(connID2, sess, token2)
+			Expect(handler.resetTokens).To(HaveLen(2))
+
+			handler.RetireResetToken(connID1)
+			Expect(handler.resetTokens).To(HaveLen(1))
+			Expect(handler.resetTokens).To(HaveKey(token2))
+			// the connection ID itself is still routable
+			handled := make(chan struct{})
+			sess.EXPECT().handlePacket(gomock.Any()).Do(func(p *receivedPacket) { close(handled) })
+			Expect(handler.handlePacket(nil, getPacket(connID1))).To(Succeed())
+			Eventually(handled).Should(BeClosed())
+		})
+	})
+
+	Context("deterministic stateless resets", func() {
+		// getShortHeaderPacket builds a short header packet of exactly length
+		// bytes: a type byte, the connection ID, filler, and trailer at the
+		// very end (overwriting filler/connID bytes if length is too small to
+		// fit everything, which individual tests must account for).
+		getShortHeaderPacket := func(connID protocol.ConnectionID, length int, trailer []byte) []byte {
+			packet := make([]byte, length)
+			packet[0] = 0x40
+			copy(packet[1:], connID)
+			copy(packet[length-len(trailer):], trailer)
+			return packet
+		}
+
+		BeforeEach(func() {
+			handler.StatelessResetKey = [32]byte{1, 2, 3, 4}
+		})
+
+		It("derives the same token a peer would derive with the same key", func() {
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5}
+			mac := hmac.New(sha256.New, handler.StatelessResetKey[:])
+			mac.Write(connID)
+			var expected [16]byte
+			copy(expected[:], mac.Sum(nil))
+			Expect(handler.getStatelessResetToken(connID)).To(Equal(expected))
+		})
+
+		It("doesn't send a reset for packets smaller than 21 bytes", func() {
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5}
+			packet := getShortHeaderPacket(connID, 20, make([]byte, 16))
+			Expect(packet).To(HaveLen(20))
+			Expect(handler.handlePacket(&net.UDPAddr{}, packet)).To(HaveOccurred())
+			Consistently(conn.dataWritten).ShouldNot(Receive())
+		})
+
+		It("doesn't send a reset for a connection ID that's still routed to a live session", func() {
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5}
+			sess := NewMockPacketHandler(mockCtrl)
+			handler.Add(connID, sess)
+			packet := getShortHeaderPacket(connID, 30, make([]byte, 16))
+			handled := make(chan struct{})
+			sess.EXPECT().handlePacket(gomock.Any()).Do(func(*receivedPacket) { close(handled) })
+			Expect(handler.handlePacket(&net.UDPAddr{}, packet)).To(Succeed())
+			Eventually(handled).Should(BeClosed())
+			Consistently(conn.dataWritten).ShouldNot(Receive())
+		})
+
+		It("evicts stale entries from the rate limiter", func() {
+			handler.lastStatelessReset["stale"] = time.Now().Add(-2 * statelessResetRateLimit)
+			handler.lastStatelessReset["fresh"] = time.Now()
+			handler.cleanupStatelessResets()
+			Expect(handler.lastStatelessReset).To(HaveKey("fresh"))
+			Expect(handler.lastStatelessReset).ToNot(HaveKey("stale"))
+		})
+
+		It("sends a stateless reset for an unknown connection ID", func() {
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5}
+			packet := getShortHeaderPacket(connID, 30, make([]byte, 16))
+			Expect(handler.handlePacket(&net.UDPAddr{}, packet)).To(HaveOccurred())
+			var reset []byte
+			Eventually(conn.dataWritten).Should(Receive(&reset))
+			Expect(reset[0] & 0x40).To(Equal(byte(0x40)))
+			Expect(reset[len(reset)-16:]).To(Equal(handler.getStatelessResetToken(connID)[:]))
+		})
+
+		It("still sends a reset for a packet exactly at the minimum eligible size", func() {
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5}
+			packet := getShortHeaderPacket(connID, minStatelessResetPacketSize, nil)
+			Expect(handler.handlePacket(&net.UDPAddr{}, packet)).To(HaveOccurred())
+			var reset []byte
+			Eventually(conn.dataWritten).Should(Receive(&reset))
+			Expect(reset[len(reset)-16:]).To(Equal(handler.getStatelessResetToken(connID)[:]))
+		})
+	})
+
+	Context("tracing", func() {
+		var tracer *MockPacketHandlerMapTracer
+
+		BeforeEach(func() {
+			tracer = NewMockPacketHandlerMapTracer(mockCtrl)
+			conn = newMockPacketConn()
+			handler = newPacketHandlerMap(conn, 5, utils.DefaultLogger, WithPacketHandlerMapTracer(tracer)).(*packetHandlerMap)
+		})
+
+		It("traces normal delivery", func() {
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+			sess := NewMockPacketHandler(mockCtrl)
+			tracer.EXPECT().SessionAdded(connID)
+			handler.Add(connID, sess)
+
+			handled := make(chan struct{})
+			sess.EXPECT().handlePacket(gomock.Any()).Do(func(*receivedPacket) { close(handled) })
+			tracer.EXPECT().PacketReceived(gomock.Any(), connID, true)
+			conn.dataToRead <- getPacket(connID)
+			Eventually(handled).Should(BeClosed())
+		})
+
+		It("traces unknown connection IDs", func() {
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+			tracer.EXPECT().PacketReceived(gomock.Any(), connID, false)
+			tracer.EXPECT().UnknownConnectionID(connID)
+			Expect(handler.handlePacket(nil, getPacket(connID))).To(HaveOccurred())
+		})
+
+		It("traces stateless resets", func() {
+			connID := protocol.ConnectionID{0xde, 0xca, 0xfb, 0xad}
+			token := [16]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+			sess := NewMockPacketHandler(mockCtrl)
+			tracer.EXPECT().SessionAdded(connID)
+			handler.AddWithResetToken(connID, sess, token)
+			packet := append([]byte{0x40}, make([]byte, 50)...)
+			packet = append(packet, token[:]...)
+			tracer.EXPECT().PacketReceived(gomock.Any(), gomock.Any(), false)
+			tracer.EXPECT().UnknownConnectionID(gomock.Any())
+			tracer.EXPECT().StatelessResetReceived(gomock.Any())
+			sess.EXPECT().destroy(errors.New("received a stateless reset"))
+			Expect(handler.handlePacket(nil, packet)).To(Succeed())
+		})
+
+		It("traces a session being retired", func() {
+			handler.deleteRetiredSessionsAfter = scaleDuration(10 * time.Millisecond)
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+			tracer.EXPECT().SessionAdded(connID)
+			handler.Add(connID, NewMockPacketHandler(mockCtrl))
+			retired := make(chan struct{})
+			tracer.EXPECT().SessionRetired(connID).Do(func(protocol.ConnectionID) { close(retired) })
+			handler.Retire(connID)
+			Eventually(retired).Should(BeClosed())
+		})
+
+		It("traces packets that arrive late for a retired session as known deliveries", func() {
+			handler.deleteRetiredSessionsAfter = time.Hour
+			connID := protocol.ConnectionID{1, 2, 3, 4, 5, 6, 7, 8}
+			sess := NewMockPacketHandler(mockCtrl)
+			tracer.EXPECT().SessionAdded(connID)
+			handler.Add(connID, sess)
+			handler.Retire(connID)
+
+			handled := make(chan struct{})
+			sess.EXPECT().handlePacket(gomock.Any()).Do(func(*receivedPacket) { close(handled) })
+			tracer.EXPECT().PacketReceived(gomock.Any(), connID, true)
+			Expect(handler.handlePacket(nil, getPacket(connID))).To(Succeed())
+			Eventually(handled).Should(BeClosed())
+		})
+
+		It("traces read errors", func() {
+			done := make(chan struct{})
+			tracer.EXPECT().ReadError(gomock.Any()).Do(func(error) { close(done) })
+			conn.Close()
+			Eventually(done).Should(BeClosed())
+		})
+	})
+
+	Context("draining", func() {
+		It("closes idle sessions immediately, leaving active ones alone", func() {
+			idleSess := NewMockPacketHandler(mockCtrl)
+			idleSess.EXPECT().isIdle().Return(true)
+			idleSess.EXPECT().destroy(gomock.Any())
+			activeSess := NewMockPacketHandler(mockCtrl)
+			activeSess.EXPECT().isIdle().Return(false)
+
+			handler.Add(protocol.ConnectionID{1, 1, 1, 1}, idleSess)
+			handler.Add(protocol.ConnectionID{2, 2, 2, 2}, activeSess)
+			handler.CloseIdleConnections()
+		})
+
+		It("returns immediately if there are no sessions left", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			Expect(handler.Shutdown(ctx)).To(Succeed())
+		})
+
+		It("waits for sessions to finish on their own", func() {
+			connID := protocol.ConnectionID{1, 1, 1, 1}
+			sess := NewMockPacketHandler(mockCtrl)
+			handler.Add(connID, sess)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				Expect(handler.Shutdown(ctx)).To(Succeed())
+			}()
+			Consistently(done).ShouldNot(BeClosed())
+			handler.Remove(connID)
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("closes remaining sessions gracefully once the context is done, even if they refuse to close", func() {
+			sess := NewMockPacketHandler(mockCtrl)
+			closed := make(chan struct{})
+			closeCalled := make(chan struct{})
+			sess.EXPECT().CloseWithError(protocol.ApplicationErrorCode(0), "server shutting down").Do(func(protocol.ApplicationErrorCode, string) {
+				close(closeCalled)
+				<-closed // never returns within the test, simulating a session that refuses to close
+			}).AnyTimes()
+			handler.Add(protocol.ConnectionID{1, 1, 1, 1}, sess)
+
+			ctx, cancel := context.WithTimeout(context.Background(), scaleDuration(10*time.Millisecond))
+			defer cancel()
+			Expect(handler.Shutdown(ctx)).To(MatchError(context.DeadlineExceeded))
+			Eventually(closeCalled).Should(BeClosed())
+			close(closed)
+		})
+
+		It("succeeds once the underlying connection is closed out from under an in-flight Shutdown", func() {
+			connID := protocol.ConnectionID{1, 1, 1, 1}
+			sess := NewMockPacketHandler(mockCtrl)
+			sess.EXPECT().destroy(gomock.Any())
+			handler.Add(connID, sess)
+
+			result := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				result <- handler.Shutdown(ctx)
+			}()
+			// makes the listen goroutine's read fail, triggering close()
+			conn.Close()
+			Eventually(result).Should(Receive(BeNil()))
+		})
 	})
 
 	Context("running a server", func() {